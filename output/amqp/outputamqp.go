@@ -1,11 +1,24 @@
 package outputamqp
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/bitly/go-hostpool"
-	"github.com/streadway/amqp"
+	amqp "github.com/rabbitmq/amqp091-go"
 	"github.com/tsaikd/gogstash/config"
 	"github.com/tsaikd/gogstash/config/logevent"
 )
@@ -13,20 +26,119 @@ import (
 // ModuleName is the name used in config file
 const ModuleName = "amqp"
 
+// Default reconnect backoff parameters, used when the matching config
+// fields are left empty.
+const (
+	defaultReconnectInterval    = "1s"
+	defaultMaxReconnectInterval = "30s"
+	defaultReconnectJitter      = "1s"
+	defaultConfirmTimeout       = "5s"
+	defaultBatchTimeout         = "10ms"
+)
+
+// Default worker-pool sizing, used when the matching config fields are left
+// at their zero value.
+const (
+	defaultNWorkers    = 1
+	defaultBatchSize   = 1
+	defaultMaxInFlight = 1000
+)
+
+// Overflow policies for queue_dir once queue_limit is reached.
+const (
+	queueOverflowDropOldest = "drop-oldest"
+	queueOverflowBlock      = "block"
+)
+
+// spoolReplayInterval is how often the background goroutine checks the
+// spool directory for events to replay once a host is healthy again.
+const spoolReplayInterval = 1 * time.Second
+
 // OutputConfig holds the output configuration json fields and internal objects
 type OutputConfig struct {
 	config.OutputConfig
-	URLs               []string `json:"urls"`                           // Array of AMQP connection strings formatted per the [RabbitMQ URI Spec](http://www.rabbitmq.com/uri-spec.html).
-	RoutingKey         string   `json:"routing_key,omitempty"`          // The message routing key used to bind the queue to the exchange. Defaults to empty string.
-	Exchange           string   `json:"exchange"`                       // AMQP exchange name
-	ExchangeType       string   `json:"exchange_type"`                  // AMQP exchange type (fanout, direct, topic or headers).
-	ExchangeDurable    bool     `json:"exchange_durable,omitempty"`     // Whether the exchange should be configured as a durable exchange. Defaults to false.
-	ExchangeAutoDelete bool     `json:"exchange_auto_delete,omitempty"` // Whether the exchange is deleted when all queues have finished and there is no publishing. Defaults to true.
-	Persistent         bool     `json:"persistent,omitempty"`           // Whether published messages should be marked as persistent or transient. Defaults to false.
-	RetryCount         int      `json:"retry_count,omitempty"`          // Number of attempts for sending a message. Defaults to 3.
-	hostPool           hostpool.HostPool
-	amqpClients        map[string]amqpConn
-	evchan             chan logevent.LogEvent
+	URLs                  []string          `json:"urls"`                              // Array of AMQP connection strings formatted per the [RabbitMQ URI Spec](http://www.rabbitmq.com/uri-spec.html).
+	RoutingKey            string            `json:"routing_key,omitempty"`             // The message routing key used to bind the queue to the exchange. Defaults to empty string.
+	Exchange              string            `json:"exchange"`                          // AMQP exchange name
+	ExchangeType          string            `json:"exchange_type"`                     // AMQP exchange type (fanout, direct, topic or headers).
+	ExchangeDurable       bool              `json:"exchange_durable,omitempty"`        // Whether the exchange should be configured as a durable exchange. Defaults to false.
+	ExchangeAutoDelete    bool              `json:"exchange_auto_delete,omitempty"`    // Whether the exchange is deleted when all queues have finished and there is no publishing. Defaults to true.
+	Persistent            bool              `json:"persistent,omitempty"`              // Whether published messages should be marked as persistent or transient. Defaults to false.
+	RetryCount            int               `json:"retry_count,omitempty"`             // Number of attempts for sending a message. Defaults to 3.
+	ReconnectInterval     string            `json:"reconnect_interval,omitempty"`      // Initial delay before the first reconnect attempt after a dropped connection. Defaults to "1s".
+	MaxReconnectInterval  string            `json:"max_reconnect_interval,omitempty"`  // Upper bound the reconnect backoff is capped at. Defaults to "30s".
+	ReconnectJitter       string            `json:"reconnect_jitter,omitempty"`        // Maximum random jitter added to each reconnect delay. Defaults to "1s".
+	QueueDir              string            `json:"queue_dir,omitempty"`               // Directory used to spool events that could not be published to any host. Spooling is disabled when empty.
+	QueueLimit            int64             `json:"queue_limit,omitempty"`             // Maximum size in bytes the spool directory is allowed to grow to. Zero means unlimited.
+	QueueOverflowPolicy   string            `json:"queue_overflow_policy,omitempty"`   // What to do once queue_limit is reached: "drop-oldest" or "block". Defaults to "drop-oldest".
+	PublisherConfirms     bool              `json:"publisher_confirms,omitempty"`      // Put channels into confirm mode and only treat a publish as delivered once the broker acks it.
+	ConfirmTimeout        string            `json:"confirm_timeout,omitempty"`         // How long to wait for a publisher confirm before treating the publish as failed. Defaults to "5s".
+	Mandatory             bool              `json:"mandatory,omitempty"`               // Ask the broker to return the message instead of silently dropping it when it is unroutable.
+	Immediate             bool              `json:"immediate,omitempty"`               // Ask the broker to return the message instead of queueing it when no consumer can handle it immediately.
+	DeliveryMode          uint8             `json:"delivery_mode,omitempty"`           // AMQP delivery mode, 1 (transient) or 2 (persistent). Defaults to Persistent ? 2 : 1.
+	Priority              uint8             `json:"priority,omitempty"`                // AMQP message priority, 0-9.
+	Headers               map[string]string `json:"headers,omitempty"`                 // Extra AMQP headers, values are event-templated.
+	ContentType           string            `json:"content_type,omitempty"`            // AMQP content type. Defaults to "application/json".
+	ContentEncoding       string            `json:"content_encoding,omitempty"`        // AMQP content encoding, e.g. "gzip". Defaults to empty.
+	RoutingTag            string            `json:"routing_tag,omitempty"`             // Event field to read the routing key from; falls back to the templated routing_key when the field is empty.
+	SSLCA                 string            `json:"ssl_ca,omitempty"`                  // Path to the CA certificate bundle used to verify the broker.
+	SSLCert               string            `json:"ssl_cert,omitempty"`                // Path to the client certificate, for TLS or SASL EXTERNAL authentication.
+	SSLKey                string            `json:"ssl_key,omitempty"`                 // Path to the client private key matching ssl_cert.
+	InsecureSkipVerify    bool              `json:"insecure_skip_verify,omitempty"`    // Skip broker certificate verification. Defaults to false.
+	AuthMethod            string            `json:"auth_method,omitempty"`             // SASL mechanism to use: "PLAIN" (default, credentials from the URL) or "EXTERNAL" (certificate-based, requires ssl_cert/ssl_key).
+	NWorkers              int               `json:"n_workers,omitempty"`               // Number of goroutines consuming evchan and publishing concurrently. Defaults to 1.
+	BatchSize             int               `json:"batch_size,omitempty"`              // Number of events a worker coalesces before publishing. Defaults to 1 (no batching).
+	BatchTimeout          string            `json:"batch_timeout,omitempty"`           // Maximum time a worker waits to fill batch_size before publishing a partial batch. Defaults to "10ms".
+	MaxInFlight           int               `json:"max_in_flight,omitempty"`           // Size of the evchan buffer; Event() blocks once this many events are queued for publishing. Defaults to 1000.
+	PropagateTraceContext bool              `json:"propagate_trace_context,omitempty"` // Inject W3C trace-context headers derived from the event into each published message.
+	TraceContextFields    []string          `json:"trace_context_fields,omitempty"`    // Extra event fields to copy verbatim into identically-named AMQP headers, in addition to traceparent/tracestate.
+
+	// Hook, when set, is called right before every publish so integrations
+	// (e.g. an APM agent) can stamp tracing headers, AppId, MessageId or
+	// CorrelationId from their own tracer without forking this plugin. It is
+	// only settable programmatically; there is no config file equivalent.
+	Hook BeforePublishHook `json:"-"`
+
+	hostPool             hostpool.HostPool
+	hostPoolMutex        sync.RWMutex
+	amqpClients          map[string]amqpConn
+	amqpClientsMutex     sync.RWMutex
+	evchan               chan logevent.LogEvent
+	reconnectInterval    time.Duration
+	maxReconnectInterval time.Duration
+	reconnectJitter      time.Duration
+	confirmTimeout       time.Duration
+	batchTimeout         time.Duration
+	spool                *diskSpool
+	metrics              amqpMetrics
+
+	correlationSeq int64
+	returnsMutex   sync.Mutex
+	returnsWait    map[string]chan amqp.Return
+}
+
+// amqpMetrics holds the publish counters operators can use to observe
+// worker-pool throughput.
+type amqpMetrics struct {
+	published int64
+	acked     int64
+	nacked    int64
+	retried   int64
+}
+
+// Metrics returns a point-in-time snapshot of the publish counters.
+func (o *OutputConfig) Metrics() (published, acked, nacked, retried int64) {
+	return atomic.LoadInt64(&o.metrics.published),
+		atomic.LoadInt64(&o.metrics.acked),
+		atomic.LoadInt64(&o.metrics.nacked),
+		atomic.LoadInt64(&o.metrics.retried)
+}
+
+// BeforePublishHook lets code embedding this plugin adjust a message right
+// before it is published, e.g. to stamp distributed-tracing headers from a
+// tracer that isn't driven off plain event fields.
+type BeforePublishHook interface {
+	BeforePublish(event logevent.LogEvent, msg *amqp.Publishing)
 }
 
 type amqpConn struct {
@@ -42,12 +154,23 @@ func DefaultOutputConfig() OutputConfig {
 				Type: ModuleName,
 			},
 		},
-		RoutingKey:         "",
-		ExchangeDurable:    false,
-		ExchangeAutoDelete: true,
-		Persistent:         false,
-		RetryCount:         3,
-		amqpClients:        map[string]amqpConn{},
+		RoutingKey:           "",
+		ExchangeDurable:      false,
+		ExchangeAutoDelete:   true,
+		Persistent:           false,
+		RetryCount:           3,
+		ReconnectInterval:    defaultReconnectInterval,
+		MaxReconnectInterval: defaultMaxReconnectInterval,
+		ReconnectJitter:      defaultReconnectJitter,
+		QueueOverflowPolicy:  queueOverflowDropOldest,
+		ConfirmTimeout:       defaultConfirmTimeout,
+		ContentType:          "application/json",
+		NWorkers:             defaultNWorkers,
+		BatchSize:            defaultBatchSize,
+		BatchTimeout:         defaultBatchTimeout,
+		MaxInFlight:          defaultMaxInFlight,
+		amqpClients:          map[string]amqpConn{},
+		returnsWait:          map[string]chan amqp.Return{},
 
 		evchan: make(chan logevent.LogEvent),
 	}
@@ -60,73 +183,1039 @@ func InitHandler(confraw *config.ConfigRaw) (retconf config.TypeOutputConfig, er
 		return
 	}
 
+	if conf.reconnectInterval, err = time.ParseDuration(conf.ReconnectInterval); err != nil {
+		return
+	}
+	if conf.maxReconnectInterval, err = time.ParseDuration(conf.MaxReconnectInterval); err != nil {
+		return
+	}
+	if conf.reconnectJitter, err = time.ParseDuration(conf.ReconnectJitter); err != nil {
+		return
+	}
+	if conf.confirmTimeout, err = time.ParseDuration(conf.ConfirmTimeout); err != nil {
+		return
+	}
+	if conf.batchTimeout, err = time.ParseDuration(conf.BatchTimeout); err != nil {
+		return
+	}
+
+	conf.evchan = make(chan logevent.LogEvent, conf.MaxInFlight)
+
+	if conf.DeliveryMode == 0 {
+		if conf.Persistent {
+			conf.DeliveryMode = amqp.Persistent
+		} else {
+			conf.DeliveryMode = amqp.Transient
+		}
+	}
+
+	if conf.QueueDir != "" {
+		if conf.spool, err = newDiskSpool(conf.QueueDir, conf.QueueLimit, conf.QueueOverflowPolicy); err != nil {
+			return
+		}
+	}
+
 	if err = conf.initAmqpClients(); err != nil {
 		return
 	}
 
+	if conf.spool != nil {
+		go conf.spoolReplayLoop()
+	}
+
+	for i := 0; i < conf.NWorkers; i++ {
+		go conf.workerLoop()
+	}
+
 	retconf = &conf
 	return
 }
 
+// dial connects to url honouring the ssl_* / auth_method config: TLS is used
+// when any ssl_* field is set or the URL scheme is amqps://, and
+// auth_method: EXTERNAL switches to SASL EXTERNAL (certificate-based) auth,
+// the setup required by RabbitMQ's rabbitmq_auth_mechanism_ssl plugin.
+func (o *OutputConfig) dial(url string) (*amqp.Connection, error) {
+	tlsConfig, err := o.tlsConfig(url)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.EqualFold(o.AuthMethod, "EXTERNAL") {
+		return amqp.DialConfig(url, amqp.Config{
+			SASL:            []amqp.Authentication{&amqp.ExternalAuth{}},
+			TLSClientConfig: tlsConfig,
+		})
+	}
+
+	if tlsConfig != nil {
+		return amqp.DialTLS(url, tlsConfig)
+	}
+
+	return amqp.Dial(url)
+}
+
+// tlsConfig builds the *tls.Config to dial url with, or nil when neither TLS
+// fields nor an amqps:// scheme were configured.
+func (o *OutputConfig) tlsConfig(url string) (*tls.Config, error) {
+	if o.SSLCA == "" && o.SSLCert == "" && o.SSLKey == "" && !strings.HasPrefix(url, "amqps://") {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: o.InsecureSkipVerify}
+
+	if o.SSLCA != "" {
+		ca, err := ioutil.ReadFile(o.SSLCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("failed to parse ssl_ca %s", o.SSLCA)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if o.SSLCert != "" && o.SSLKey != "" {
+		cert, err := tls.LoadX509KeyPair(o.SSLCert, o.SSLKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
 func (o *OutputConfig) initAmqpClients() error {
-	var hosts []string
+	var connected bool
 
 	for _, url := range o.URLs {
-		if conn, err := amqp.Dial(url); err == nil {
+		if conn, err := o.dial(url); err == nil {
 			if ch, err := conn.Channel(); err == nil {
-				o.amqpClients[url] = amqpConn{Channel: ch, Connection: conn}
-				err := ch.ExchangeDeclare(
-					o.Exchange,
-					o.ExchangeType,
-					o.ExchangeDurable,
-					o.ExchangeAutoDelete,
-					false,
-					false,
-					nil,
-				)
+				returns, err := o.prepareChannel(ch)
 				if err != nil {
 					return err
 				}
-				hosts = append(hosts, url)
+				o.amqpClientsMutex.Lock()
+				o.amqpClients[url] = amqpConn{Channel: ch, Connection: conn}
+				o.amqpClientsMutex.Unlock()
+				o.watchConnection(url, conn, ch)
+				o.watchReturns(url, returns)
+				connected = true
 			}
 		}
 	}
 
-	if len(hosts) == 0 {
+	if !connected {
 		return errors.New("no valid amqp server connection found")
 	}
 
-	o.hostPool = hostpool.New(hosts)
+	// The pool always covers every configured URL, not just the ones that
+	// happened to be up at startup, so it can never shrink to zero hosts:
+	// hostpool.New on an empty slice panics the next time Get() is called.
+	// publish() reports per-host health back to the pool via resp.Mark
+	// instead of us rebuilding it as hosts connect and disconnect.
+	o.hostPoolMutex.Lock()
+	o.hostPool = hostpool.New(o.URLs)
+	o.hostPoolMutex.Unlock()
+	return nil
+}
+
+// declareExchange (re)declares the configured exchange on the given channel
+// using the parameters supplied in the config.
+func (o *OutputConfig) declareExchange(ch *amqp.Channel) error {
+	return ch.ExchangeDeclare(
+		o.Exchange,
+		o.ExchangeType,
+		o.ExchangeDurable,
+		o.ExchangeAutoDelete,
+		false,
+		false,
+		nil,
+	)
+}
+
+// prepareChannel puts ch into publisher-confirm mode when configured, arms
+// NotifyReturn so mandatory/immediate returns can be observed, and
+// (re)declares the exchange. It is called both on first connect and after
+// every reconnect.
+func (o *OutputConfig) prepareChannel(ch *amqp.Channel) (<-chan amqp.Return, error) {
+	if o.PublisherConfirms {
+		if err := ch.Confirm(false); err != nil {
+			return nil, err
+		}
+	}
+
+	var returns <-chan amqp.Return
+	if o.Mandatory || o.Immediate {
+		returns = ch.NotifyReturn(make(chan amqp.Return, 1))
+	}
+
+	return returns, o.declareExchange(ch)
+}
+
+// watchConnection arms NotifyClose listeners on both the connection and the
+// channel for url, and reconnects in the background the moment either one
+// reports a close.
+func (o *OutputConfig) watchConnection(url string, conn *amqp.Connection, ch *amqp.Channel) {
+	connErrs := conn.NotifyClose(make(chan *amqp.Error, 1))
+	chanErrs := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+	go func() {
+		select {
+		case err := <-connErrs:
+			log.Errorf("amqp connection to %s closed: %v", url, err)
+		case err := <-chanErrs:
+			log.Errorf("amqp channel to %s closed: %v", url, err)
+		}
+
+		o.amqpClientsMutex.Lock()
+		delete(o.amqpClients, url)
+		o.amqpClientsMutex.Unlock()
+
+		o.reconnect(url)
+	}()
+}
+
+// watchReturns drains returns in the background so a slow consumer of
+// NotifyReturn can never stall a publish. Every return is correlated back
+// to its in-flight publish via CorrelationId (see prepareMandatoryWait):
+// when a waiter is registered, the return is handed to it instead of being
+// logged here, letting publish()/deliverBatch treat it the same as any
+// other publish failure (retry against another host, eventually spool).
+// Returns with no registered waiter (the wait already timed out, or the
+// message predates this process's bookkeeping) are just logged and
+// counted as nacked.
+func (o *OutputConfig) watchReturns(url string, returns <-chan amqp.Return) {
+	if returns == nil {
+		return
+	}
+	go func() {
+		for ret := range returns {
+			o.returnsMutex.Lock()
+			waiter, ok := o.returnsWait[ret.CorrelationId]
+			if ok {
+				delete(o.returnsWait, ret.CorrelationId)
+			}
+			o.returnsMutex.Unlock()
+
+			if ok {
+				waiter <- ret
+				continue
+			}
+
+			atomic.AddInt64(&o.metrics.nacked, 1)
+			log.Errorf("amqp message to %s returned: %d %s", url, ret.ReplyCode, ret.ReplyText)
+		}
+	}()
+}
+
+// returnGracePeriod bounds how long publish()/deliverBatch wait, once a
+// mandatory/immediate publish has been sent (or confirmed), for
+// watchReturns to hand back a correlated basic.return. The broker sends a
+// return before the matching ack, so this only needs to cover scheduling
+// delay in watchReturns, not a full network round trip.
+const returnGracePeriod = 50 * time.Millisecond
+
+// prepareMandatoryWait registers msg for return correlation when
+// mandatory or immediate is set, stamping a CorrelationId onto it first if
+// one wasn't already set (e.g. by a BeforePublishHook). It returns nil when
+// neither flag is set, since there is nothing for the broker to return.
+func (o *OutputConfig) prepareMandatoryWait(msg *amqp.Publishing) chan amqp.Return {
+	if !o.Mandatory && !o.Immediate {
+		return nil
+	}
+	if msg.CorrelationId == "" {
+		msg.CorrelationId = fmt.Sprintf("amqp-%d", atomic.AddInt64(&o.correlationSeq, 1))
+	}
+
+	waiter := make(chan amqp.Return, 1)
+	o.returnsMutex.Lock()
+	o.returnsWait[msg.CorrelationId] = waiter
+	o.returnsMutex.Unlock()
+	return waiter
+}
+
+// clearMandatoryWait unregisters a waiter registered by prepareMandatoryWait,
+// used when the publish itself failed before a return could ever arrive.
+func (o *OutputConfig) clearMandatoryWait(correlationID string) {
+	o.returnsMutex.Lock()
+	delete(o.returnsWait, correlationID)
+	o.returnsMutex.Unlock()
+}
+
+// awaitMandatoryReturn waits up to returnGracePeriod on waiter for a
+// basic.return correlated to correlationID. It reports whether one arrived;
+// when none does within the grace period, the waiter is unregistered so a
+// very late or nonexistent return can't wedge watchReturns' map.
+func (o *OutputConfig) awaitMandatoryReturn(correlationID string, waiter chan amqp.Return) (amqp.Return, bool) {
+	select {
+	case ret := <-waiter:
+		return ret, true
+	case <-time.After(returnGracePeriod):
+		o.clearMandatoryWait(correlationID)
+		return amqp.Return{}, false
+	}
+}
+
+// reconnect redials url with an exponential backoff (plus jitter), re-opens
+// the channel, re-declares the exchange and swaps the result back into
+// amqpClients once it succeeds.
+func (o *OutputConfig) reconnect(url string) {
+	delay := o.reconnectInterval
+
+	for {
+		time.Sleep(delay + o.jitter())
+
+		conn, err := o.dial(url)
+		if err != nil {
+			log.Errorf("amqp reconnect to %s failed: %v", url, err)
+			delay = o.nextDelay(delay)
+			continue
+		}
+
+		ch, err := conn.Channel()
+		if err != nil {
+			log.Errorf("amqp channel open to %s failed: %v", url, err)
+			conn.Close()
+			delay = o.nextDelay(delay)
+			continue
+		}
+
+		returns, err := o.prepareChannel(ch)
+		if err != nil {
+			log.Errorf("amqp channel setup on %s failed: %v", url, err)
+			ch.Close()
+			conn.Close()
+			delay = o.nextDelay(delay)
+			continue
+		}
+
+		o.amqpClientsMutex.Lock()
+		o.amqpClients[url] = amqpConn{Channel: ch, Connection: conn}
+		o.amqpClientsMutex.Unlock()
+
+		o.watchConnection(url, conn, ch)
+		o.watchReturns(url, returns)
+		return
+	}
+}
+
+func (o *OutputConfig) nextDelay(delay time.Duration) time.Duration {
+	delay *= 2
+	if delay > o.maxReconnectInterval {
+		delay = o.maxReconnectInterval
+	}
+	return delay
+}
+
+func (o *OutputConfig) jitter() time.Duration {
+	if o.reconnectJitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(o.reconnectJitter)))
+}
+
+// spoolRecord is the on-disk representation of a single spooled event; it
+// keeps enough of the original publish arguments to replay it faithfully.
+type spoolRecord struct {
+	Exchange        string                 `json:"exchange"`
+	RoutingKey      string                 `json:"routing_key"`
+	Body            []byte                 `json:"body"`
+	Headers         map[string]interface{} `json:"headers,omitempty"`
+	ContentType     string                 `json:"content_type,omitempty"`
+	ContentEncoding string                 `json:"content_encoding,omitempty"`
+	DeliveryMode    uint8                  `json:"delivery_mode,omitempty"`
+	Priority        uint8                  `json:"priority,omitempty"`
+}
+
+// toPublishing rebuilds the amqp.Publishing a spoolRecord was created from.
+func (r spoolRecord) toPublishing() amqp.Publishing {
+	var headers amqp.Table
+	if len(r.Headers) > 0 {
+		headers = amqp.Table(r.Headers)
+	}
+	return amqp.Publishing{
+		ContentType:     r.ContentType,
+		ContentEncoding: r.ContentEncoding,
+		DeliveryMode:    r.DeliveryMode,
+		Priority:        r.Priority,
+		Headers:         headers,
+		Body:            r.Body,
+	}
+}
+
+func newSpoolRecord(exchange, routingKey string, msg amqp.Publishing) spoolRecord {
+	var headers map[string]interface{}
+	if len(msg.Headers) > 0 {
+		headers = map[string]interface{}(msg.Headers)
+	}
+	return spoolRecord{
+		Exchange:        exchange,
+		RoutingKey:      routingKey,
+		Body:            msg.Body,
+		Headers:         headers,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		DeliveryMode:    msg.DeliveryMode,
+		Priority:        msg.Priority,
+	}
+}
+
+// diskSpool is a crash-safe, disk-backed FIFO queue used to hold events that
+// could not be delivered to any AMQP host.
+type diskSpool struct {
+	dir      string
+	limit    int64
+	overflow string
+
+	mu   sync.Mutex
+	size int64
+}
+
+func newDiskSpool(dir string, limit int64, overflow string) (*diskSpool, error) {
+	if overflow == "" {
+		overflow = queueOverflowDropOldest
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	s := &diskSpool{dir: dir, limit: limit, overflow: overflow}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range files {
+		s.size += fi.Size()
+	}
+	return s, nil
+}
+
+// enqueue appends a spool record to disk, fsyncing before returning so a
+// crash right after cannot lose the event. When queue_limit is set it either
+// drops the oldest spooled event or blocks until room is made, per
+// queue_overflow_policy.
+func (s *diskSpool) enqueue(exchange, routingKey string, msg amqp.Publishing) error {
+	raw, err := json.Marshal(newSpoolRecord(exchange, routingKey, msg))
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.limit > 0 && s.size+int64(len(raw)) > s.limit {
+		switch s.overflow {
+		case queueOverflowBlock:
+			s.mu.Unlock()
+			time.Sleep(spoolReplayInterval)
+			s.mu.Lock()
+		default:
+			if err := s.dropOldestLocked(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return s.writeLocked(raw)
+}
+
+// writeLocked must be called with s.mu held; it creates a new spool file,
+// flushes it to disk and accounts for its size.
+func (s *diskSpool) writeLocked(raw []byte) error {
+	path := filepath.Join(s.dir, fmt.Sprintf("%020d.json", time.Now().UnixNano()))
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(raw); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	s.size += int64(len(raw))
+	return nil
+}
+
+// dropOldestLocked must be called with s.mu held; it removes the oldest
+// spooled file to make room for a new one.
+func (s *diskSpool) dropOldestLocked() error {
+	names, err := s.sortedNamesLocked()
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	oldest := filepath.Join(s.dir, names[0])
+	fi, err := os.Stat(oldest)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(oldest); err != nil {
+		return err
+	}
+	s.size -= fi.Size()
 	return nil
 }
 
-// Event send the event through AMQP
+// dequeue removes and returns the oldest spooled record, if any.
+func (s *diskSpool) dequeue() (rec spoolRecord, ok bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names, err := s.sortedNamesLocked()
+	if err != nil {
+		return rec, false, err
+	}
+	if len(names) == 0 {
+		return rec, false, nil
+	}
+
+	path := filepath.Join(s.dir, names[0])
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return rec, false, err
+	}
+	if err := json.Unmarshal(raw, &rec); err != nil {
+		return rec, false, err
+	}
+	if err := os.Remove(path); err != nil {
+		return rec, false, err
+	}
+
+	s.size -= int64(len(raw))
+	return rec, true, nil
+}
+
+// requeue puts a previously dequeued record back at the tail of the spool,
+// used when a replay attempt fails.
+func (s *diskSpool) requeue(rec spoolRecord) error {
+	raw, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writeLocked(raw)
+}
+
+// sortedNamesLocked must be called with s.mu held.
+func (s *diskSpool) sortedNamesLocked() ([]string, error) {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, fi := range entries {
+		if fi.IsDir() {
+			continue
+		}
+		names = append(names, fi.Name())
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Event hands the event off to the worker pool and returns immediately; the
+// event is queued on evchan, which blocks once max_in_flight events are
+// already waiting to be published.
 func (o *OutputConfig) Event(event logevent.LogEvent) (err error) {
-	raw, err := event.MarshalJSON()
+	o.evchan <- event
+	return nil
+}
+
+// workerLoop is run by each of the n_workers goroutines: it pulls batches of
+// events off evchan and publishes them through a channel dedicated to this
+// worker, acquired once and reused across batches, so n_workers workers
+// publish concurrently on n_workers channels instead of contending for the
+// single shared channel each amqpClients entry keeps for connection
+// bookkeeping.
+func (o *OutputConfig) workerLoop() {
+	var w *workerChannel
+	for {
+		batch := o.collectBatch()
+		if batch == nil {
+			o.closeWorkerChannel(w)
+			return
+		}
+		w = o.deliverBatch(w, batch)
+	}
+}
+
+// collectBatch blocks for the first event, then keeps filling the batch up
+// to BatchSize until either it is full or batch_timeout elapses, whichever
+// comes first. Returns nil once evchan is closed.
+func (o *OutputConfig) collectBatch() []logevent.LogEvent {
+	first, ok := <-o.evchan
+	if !ok {
+		return nil
+	}
+	batch := []logevent.LogEvent{first}
+	if o.BatchSize <= 1 {
+		return batch
+	}
+
+	timer := time.NewTimer(o.batchTimeout)
+	defer timer.Stop()
+
+	for len(batch) < o.BatchSize {
+		select {
+		case event, ok := <-o.evchan:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, event)
+		case <-timer.C:
+			return batch
+		}
+	}
+	return batch
+}
+
+// publishOrSpool publishes msg via publish(), which already retries against
+// every host in the pool, and spools it to disk on failure when queue_dir
+// is configured.
+func (o *OutputConfig) publishOrSpool(exchange, routingKey string, msg amqp.Publishing) {
+	if err := o.publish(exchange, routingKey, msg); err != nil {
+		atomic.AddInt64(&o.metrics.nacked, 1)
+		if o.spool == nil {
+			log.Errorf("amqp publish failed, event dropped: %v", err)
+			return
+		}
+		if spoolErr := o.spool.enqueue(exchange, routingKey, msg); spoolErr != nil {
+			log.Errorf("failed to spool event after publish failure: %v", spoolErr)
+			return
+		}
+		log.Warnf("amqp publish failed, event spooled to %s: %v", o.QueueDir, err)
+		return
+	}
+
+	atomic.AddInt64(&o.metrics.acked, 1)
+}
+
+// workerChannel is a single AMQP channel a worker keeps for the lifetime of
+// several batches, opened on a connection picked from the hostpool. resp is
+// the hostpool.Get() response that selected host; it is marked exactly once,
+// with the outcome of this channel's actual use, when the channel is
+// discarded (see discardWorkerChannel) rather than at acquisition time, so a
+// host that keeps failing publishes on its dedicated channel is eventually
+// reported to the pool the same as a per-event publish() failure would be.
+type workerChannel struct {
+	host    string
+	channel *amqp.Channel
+	resp    hostpool.HostPoolResponse
+}
+
+// acquireWorkerChannel picks a host from the pool and opens a fresh channel
+// on its connection. Every worker doing this independently, instead of all
+// of them publishing through amqpClients[host].Channel, is what lets
+// n_workers actually raise publish concurrency rather than just adding
+// goroutines that contend for the same handful of channels. It returns nil
+// (never an error) when no channel could be opened right now, so callers
+// fall back to the ordinary per-event path in publish(), which already
+// knows how to find a working host.
+func (o *OutputConfig) acquireWorkerChannel() *workerChannel {
+	o.hostPoolMutex.RLock()
+	pool := o.hostPool
+	o.hostPoolMutex.RUnlock()
+	if pool == nil || len(pool.Hosts()) == 0 {
+		return nil
+	}
+
+	resp := pool.Get()
+	host := resp.Host()
+
+	o.amqpClientsMutex.RLock()
+	client, ok := o.amqpClients[host]
+	o.amqpClientsMutex.RUnlock()
+	if !ok {
+		resp.Mark(fmt.Errorf("amqp host %s is not currently connected", host))
+		return nil
+	}
+
+	ch, err := client.Connection.Channel()
+	if err != nil {
+		resp.Mark(err)
+		return nil
+	}
+	returns, err := o.prepareChannel(ch)
 	if err != nil {
-		log.Errorf("event Marshal failed: %v", event)
+		ch.Close()
+		resp.Mark(err)
+		return nil
+	}
+
+	o.watchReturns(host, returns)
+	return &workerChannel{host: host, channel: ch, resp: resp}
+}
+
+// ensureWorkerChannel returns w unchanged if non-nil, otherwise acquires a
+// fresh one.
+func (o *OutputConfig) ensureWorkerChannel(w *workerChannel) *workerChannel {
+	if w != nil {
+		return w
+	}
+	return o.acquireWorkerChannel()
+}
+
+// closeWorkerChannel closes w's channel, if any, without reporting an
+// outcome to the hostpool. Used when a worker is shutting down, where
+// there's no publish failure to attribute to its host. Safe to call with
+// nil.
+func (o *OutputConfig) closeWorkerChannel(w *workerChannel) {
+	if w == nil {
 		return
 	}
+	w.channel.Close()
+}
+
+// discardWorkerChannel closes w's channel and marks its host's hostpool
+// response with err, if any. Safe to call with nil. Called whenever w turns
+// out to be unusable (a hard publish error) or its batch ended with at
+// least one failed delivery, so a host that keeps failing is eventually
+// marked dead and skipped, instead of silently eating failures forever
+// because its one-time hostpool response was already spent at acquisition.
+func (o *OutputConfig) discardWorkerChannel(w *workerChannel, err error) {
+	if w == nil {
+		return
+	}
+	w.resp.Mark(err)
+	w.channel.Close()
+}
+
+// pendingBatchPublish tracks one event's outcome while a batch is
+// pipelined: its publisher confirm (if any) and mandatory/immediate return
+// waiter (if any) are waited on only after every event in the batch has
+// already been published.
+type pendingBatchPublish struct {
+	exchange   string
+	routingKey string
+	msg        amqp.Publishing
+	confirm    *amqp.DeferredConfirmation
+	waiter     chan amqp.Return
+}
+
+// deliverBatch publishes an entire batch through w, firing every publish
+// before waiting on any of their outcomes, then waits on all of those
+// outcomes concurrently, so the batch's publisher confirms (and any broker
+// returns) overlap instead of each event paying for its own confirm_timeout
+// or return grace period before the next one is even checked. w is reused
+// across batches as long as every delivery through it keeps succeeding; if
+// it breaks partway through, or any of its pipelined publishes ultimately
+// fails, or it was never acquired, the affected events fall back one by one
+// to the ordinary per-event retry path in publish(), and w's host is
+// reported to the hostpool so a consistently failing host gets skipped by
+// later batches. Returns the worker channel to reuse (or re-acquire, if nil)
+// on the next batch.
+func (o *OutputConfig) deliverBatch(w *workerChannel, batch []logevent.LogEvent) *workerChannel {
+	w = o.ensureWorkerChannel(w)
+
+	pending := make([]pendingBatchPublish, 0, len(batch))
+
+	for _, event := range batch {
+		raw, err := event.MarshalJSON()
+		if err != nil {
+			log.Errorf("event Marshal failed: %v", event)
+			continue
+		}
+
+		exchange := event.Format(o.Exchange)
+		routingKey := o.routingKeyFor(event)
+		msg := o.buildPublishing(event, raw)
+		atomic.AddInt64(&o.metrics.published, 1)
+
+		if w == nil {
+			o.publishOrSpool(exchange, routingKey, msg)
+			continue
+		}
+
+		waiter := o.prepareMandatoryWait(&msg)
 
-	exchange := event.Format(o.Exchange)
-	routingKey := event.Format(o.RoutingKey)
+		if o.PublisherConfirms {
+			confirm, publishErr := w.channel.PublishWithDeferredConfirm(exchange, routingKey, o.Mandatory, o.Immediate, msg)
+			err = publishErr
+			if err == nil {
+				pending = append(pending, pendingBatchPublish{exchange: exchange, routingKey: routingKey, msg: msg, confirm: confirm, waiter: waiter})
+				continue
+			}
+		} else {
+			err = w.channel.Publish(exchange, routingKey, o.Mandatory, o.Immediate, msg)
+			if err == nil {
+				pending = append(pending, pendingBatchPublish{exchange: exchange, routingKey: routingKey, msg: msg, waiter: waiter})
+				continue
+			}
+		}
 
+		if waiter != nil {
+			o.clearMandatoryWait(msg.CorrelationId)
+		}
+		o.discardWorkerChannel(w, err)
+		w = nil
+		o.publishOrSpool(exchange, routingKey, msg)
+	}
+
+	if len(pending) == 0 {
+		return w
+	}
+
+	var wg sync.WaitGroup
+	var failures int32
+	for _, p := range pending {
+		wg.Add(1)
+		go func(p pendingBatchPublish) {
+			defer wg.Done()
+			if err := o.finishBatchPublish(p); err != nil {
+				atomic.AddInt32(&failures, 1)
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	if w != nil {
+		if failures > 0 {
+			o.discardWorkerChannel(w, fmt.Errorf("%d of %d pipelined publishes failed on host %s", failures, len(pending), w.host))
+			w = nil
+		} else {
+			w.resp.Mark(nil)
+		}
+	}
+
+	return w
+}
+
+// finishBatchPublish waits for one pipelined publish's outcome and either
+// counts it as acked or falls back to the ordinary per-event retry path in
+// publish(), the same as a synchronous publish failure would. Returns the
+// error behind that outcome, if any, so deliverBatch can decide whether the
+// worker channel they were all pipelined through is still good.
+func (o *OutputConfig) finishBatchPublish(p pendingBatchPublish) error {
+	err := o.awaitConfirm(p.confirm)
+	if err == nil && p.waiter != nil {
+		if ret, returned := o.awaitMandatoryReturn(p.msg.CorrelationId, p.waiter); returned {
+			err = fmt.Errorf("amqp broker returned message: %d %s", ret.ReplyCode, ret.ReplyText)
+		}
+	} else if p.waiter != nil {
+		o.clearMandatoryWait(p.msg.CorrelationId)
+	}
+
+	if err != nil {
+		o.publishOrSpool(p.exchange, p.routingKey, p.msg)
+		return err
+	}
+
+	atomic.AddInt64(&o.metrics.acked, 1)
+	return nil
+}
+
+// routingKeyFor resolves the routing key to publish with: when RoutingTag is
+// set the value is read from that event field, mirroring the Telegraf AMQP
+// output's routing_tag behaviour, falling back to the templated RoutingKey
+// when the field is empty.
+func (o *OutputConfig) routingKeyFor(event logevent.LogEvent) string {
+	if o.RoutingTag != "" {
+		if tag := event.Format("%{" + o.RoutingTag + "}"); tag != "" {
+			return tag
+		}
+	}
+	return event.Format(o.RoutingKey)
+}
+
+// buildPublishing assembles the AMQP message for event, templating header
+// values against the event the same way Exchange/RoutingKey are templated.
+func (o *OutputConfig) buildPublishing(event logevent.LogEvent, raw []byte) amqp.Publishing {
+	var headers amqp.Table
+	if len(o.Headers) > 0 {
+		headers = make(amqp.Table, len(o.Headers))
+		for key, value := range o.Headers {
+			headers[key] = event.Format(value)
+		}
+	}
+	headers = o.injectTraceContext(event, headers)
+
+	msg := amqp.Publishing{
+		ContentType:     o.ContentType,
+		ContentEncoding: o.ContentEncoding,
+		DeliveryMode:    o.DeliveryMode,
+		Priority:        o.Priority,
+		Headers:         headers,
+		Body:            raw,
+	}
+
+	if o.Hook != nil {
+		o.Hook.BeforePublish(event, &msg)
+	}
+
+	return msg
+}
+
+// injectTraceContext stamps W3C trace-context headers derived from event
+// onto headers when propagate_trace_context is enabled: traceparent is read
+// straight from an event field of the same name, falling back to
+// constructing one from trace_id/span_id, tracestate is copied verbatim
+// when present, and any field listed in trace_context_fields is copied into
+// an identically-named header.
+func (o *OutputConfig) injectTraceContext(event logevent.LogEvent, headers amqp.Table) amqp.Table {
+	if !o.PropagateTraceContext {
+		return headers
+	}
+	if headers == nil {
+		headers = amqp.Table{}
+	}
+
+	if traceparent := event.Format("%{traceparent}"); traceparent != "" {
+		headers["traceparent"] = traceparent
+	} else if traceID := event.Format("%{trace_id}"); traceID != "" {
+		spanID := event.Format("%{span_id}")
+		headers["traceparent"] = fmt.Sprintf("00-%s-%s-01", traceID, spanID)
+	}
+
+	if tracestate := event.Format("%{tracestate}"); tracestate != "" {
+		headers["tracestate"] = tracestate
+	}
+
+	for _, field := range o.TraceContextFields {
+		if value := event.Format("%{" + field + "}"); value != "" {
+			headers[field] = value
+		}
+	}
+
+	return headers
+}
+
+// publish attempts to deliver msg to exchange/routingKey, retrying against
+// RetryCount other hosts from the pool before giving up. When
+// publisher_confirms is enabled, a broker Nack or a confirm timeout is
+// treated the same as a publish error and triggers the next retry; when
+// mandatory/immediate is set, a correlated basic.return (see
+// prepareMandatoryWait) is too, so an unroutable message is retried and
+// ultimately spooled exactly like any other delivery failure instead of
+// silently being recorded as delivered. Every attempt is reported back to
+// the pool via resp.Mark so it keeps steering traffic away from hosts that
+// are currently down.
+func (o *OutputConfig) publish(exchange, routingKey string, msg amqp.Publishing) (err error) {
 	for i := 0; i <= o.RetryCount; i++ {
-		host := o.hostPool.Get().Host()
-		err = o.amqpClients[host].Channel.Publish(
-			exchange,
-			routingKey,
-			false,
-			false,
-			amqp.Publishing{
-				ContentType: "application/json",
-				Body:        raw,
-			},
-		)
+		if i > 0 {
+			atomic.AddInt64(&o.metrics.retried, 1)
+		}
+
+		o.hostPoolMutex.RLock()
+		pool := o.hostPool
+		o.hostPoolMutex.RUnlock()
+		if pool == nil || len(pool.Hosts()) == 0 {
+			err = errors.New("no amqp hosts configured")
+			continue
+		}
+
+		resp := pool.Get()
+		host := resp.Host()
+
+		o.amqpClientsMutex.RLock()
+		client, ok := o.amqpClients[host]
+		o.amqpClientsMutex.RUnlock()
+		if !ok {
+			err = fmt.Errorf("amqp host %s is not currently connected", host)
+			resp.Mark(err)
+			continue
+		}
+
+		waiter := o.prepareMandatoryWait(&msg)
+
+		if o.PublisherConfirms {
+			err = o.publishWithConfirm(client.Channel, exchange, routingKey, msg)
+		} else {
+			err = client.Channel.Publish(exchange, routingKey, o.Mandatory, o.Immediate, msg)
+		}
+
+		if waiter != nil {
+			if err == nil {
+				if ret, returned := o.awaitMandatoryReturn(msg.CorrelationId, waiter); returned {
+					err = fmt.Errorf("amqp broker returned message: %d %s", ret.ReplyCode, ret.ReplyText)
+				}
+			} else {
+				o.clearMandatoryWait(msg.CorrelationId)
+			}
+		}
+
+		resp.Mark(err)
 		if err == nil {
 			break
 		}
 	}
 
 	return
-}
\ No newline at end of file
+}
+
+// publishWithConfirm publishes msg and blocks until the broker acks it,
+// Nacks it, or confirm_timeout elapses.
+func (o *OutputConfig) publishWithConfirm(ch *amqp.Channel, exchange, routingKey string, msg amqp.Publishing) error {
+	confirmation, err := ch.PublishWithDeferredConfirm(exchange, routingKey, o.Mandatory, o.Immediate, msg)
+	if err != nil {
+		return err
+	}
+	return o.awaitConfirm(confirmation)
+}
+
+// awaitConfirm blocks until confirmation is acked, Nacked, or confirmTimeout
+// elapses. A nil confirmation (publisher_confirms disabled) is treated as
+// an immediate success.
+func (o *OutputConfig) awaitConfirm(confirmation *amqp.DeferredConfirmation) error {
+	if confirmation == nil {
+		return nil
+	}
+
+	select {
+	case <-confirmation.Done():
+		if !confirmation.Acked() {
+			return errors.New("amqp broker nacked publisher confirm")
+		}
+		return nil
+	case <-time.After(o.confirmTimeout):
+		return errors.New("amqp publisher confirm timed out")
+	}
+}
+
+// spoolReplayLoop periodically replays spooled events once at least one
+// host is reachable again.
+func (o *OutputConfig) spoolReplayLoop() {
+	ticker := time.NewTicker(spoolReplayInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		o.amqpClientsMutex.RLock()
+		healthy := len(o.amqpClients) > 0
+		o.amqpClientsMutex.RUnlock()
+		if !healthy {
+			continue
+		}
+
+		for {
+			rec, ok, err := o.spool.dequeue()
+			if err != nil {
+				log.Errorf("failed to read spooled event: %v", err)
+				break
+			}
+			if !ok {
+				break
+			}
+			if err := o.publish(rec.Exchange, rec.RoutingKey, rec.toPublishing()); err != nil {
+				if reErr := o.spool.requeue(rec); reErr != nil {
+					log.Errorf("failed to requeue spooled event: %v", reErr)
+				}
+				break
+			}
+		}
+	}
+}
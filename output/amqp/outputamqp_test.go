@@ -0,0 +1,263 @@
+package outputamqp
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/tsaikd/gogstash/config/logevent"
+)
+
+func TestRoutingKeyFor(t *testing.T) {
+	event := logevent.LogEvent{
+		Message: "hello",
+		Extra: map[string]interface{}{
+			"routing_tag": "orders.created",
+		},
+	}
+
+	cases := []struct {
+		name       string
+		routingTag string
+		routingKey string
+		want       string
+	}{
+		{
+			name:       "routing tag resolves to an event field",
+			routingTag: "routing_tag",
+			routingKey: "fallback",
+			want:       "orders.created",
+		},
+		{
+			name:       "missing routing tag field falls back to routing_key",
+			routingTag: "no_such_field",
+			routingKey: "fallback",
+			want:       "fallback",
+		},
+		{
+			name:       "no routing tag configured uses routing_key as-is",
+			routingTag: "",
+			routingKey: "%{[routing_tag]}",
+			want:       "%{[routing_tag]}",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			o := &OutputConfig{RoutingTag: c.routingTag, RoutingKey: c.routingKey}
+			if got := o.routingKeyFor(event); got != c.want {
+				t.Errorf("routingKeyFor() = %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestInjectTraceContext(t *testing.T) {
+	t.Run("disabled leaves headers untouched", func(t *testing.T) {
+		o := &OutputConfig{}
+		event := logevent.LogEvent{Extra: map[string]interface{}{"traceparent": "00-a-b-01"}}
+		got := o.injectTraceContext(event, nil)
+		if got != nil {
+			t.Errorf("injectTraceContext() = %v, want nil", got)
+		}
+	})
+
+	t.Run("traceparent field is copied verbatim", func(t *testing.T) {
+		o := &OutputConfig{PropagateTraceContext: true}
+		event := logevent.LogEvent{Extra: map[string]interface{}{
+			"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			"tracestate":  "congo=t61rcWkgMzE",
+		}}
+		got := o.injectTraceContext(event, nil)
+		if want := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"; got["traceparent"] != want {
+			t.Errorf("headers[traceparent] = %v, want %q", got["traceparent"], want)
+		}
+		if want := "congo=t61rcWkgMzE"; got["tracestate"] != want {
+			t.Errorf("headers[tracestate] = %v, want %q", got["tracestate"], want)
+		}
+	})
+
+	t.Run("trace_id/span_id are combined when traceparent is absent", func(t *testing.T) {
+		o := &OutputConfig{PropagateTraceContext: true}
+		event := logevent.LogEvent{Extra: map[string]interface{}{
+			"trace_id": "4bf92f3577b34da6a3ce929d0e0e4736",
+			"span_id":  "00f067aa0ba902b7",
+		}}
+		got := o.injectTraceContext(event, nil)
+		want := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+		if got["traceparent"] != want {
+			t.Errorf("headers[traceparent] = %v, want %q", got["traceparent"], want)
+		}
+	})
+
+	t.Run("trace_context_fields are copied by name", func(t *testing.T) {
+		o := &OutputConfig{PropagateTraceContext: true, TraceContextFields: []string{"baggage"}}
+		event := logevent.LogEvent{Extra: map[string]interface{}{"baggage": "userId=alice"}}
+		got := o.injectTraceContext(event, amqp.Table{})
+		if want := "userId=alice"; got["baggage"] != want {
+			t.Errorf("headers[baggage] = %v, want %q", got["baggage"], want)
+		}
+	})
+}
+
+func TestMandatoryReturnCorrelation(t *testing.T) {
+	t.Run("a correlated return is handed to its waiter, not logged as a stray nack", func(t *testing.T) {
+		o := &OutputConfig{Mandatory: true, returnsWait: map[string]chan amqp.Return{}}
+		msg := amqp.Publishing{Body: []byte("x")}
+
+		waiter := o.prepareMandatoryWait(&msg)
+		if waiter == nil {
+			t.Fatal("prepareMandatoryWait() = nil, want a waiter channel when Mandatory is set")
+		}
+		if msg.CorrelationId == "" {
+			t.Fatal("prepareMandatoryWait() did not stamp a CorrelationId")
+		}
+
+		returns := make(chan amqp.Return, 1)
+		returns <- amqp.Return{CorrelationId: msg.CorrelationId, ReplyCode: 312, ReplyText: "NO_ROUTE"}
+		close(returns)
+		o.watchReturns("amqp://broker", returns)
+
+		ret, returned := o.awaitMandatoryReturn(msg.CorrelationId, waiter)
+		if !returned {
+			t.Fatal("awaitMandatoryReturn() returned = false, want true")
+		}
+		if ret.ReplyCode != 312 {
+			t.Errorf("ret.ReplyCode = %d, want 312", ret.ReplyCode)
+		}
+		if _, _, nacked, _ := o.Metrics(); nacked != 0 {
+			t.Errorf("correlated return must not count as a stray nack, nacked = %d", nacked)
+		}
+	})
+
+	t.Run("no return within the grace period leaves the publish unmarked", func(t *testing.T) {
+		o := &OutputConfig{Mandatory: true, returnsWait: map[string]chan amqp.Return{}}
+		msg := amqp.Publishing{Body: []byte("x")}
+		waiter := o.prepareMandatoryWait(&msg)
+
+		if _, returned := o.awaitMandatoryReturn(msg.CorrelationId, waiter); returned {
+			t.Fatal("awaitMandatoryReturn() returned = true, want false when nothing arrives")
+		}
+
+		o.returnsMutex.Lock()
+		_, stillWaiting := o.returnsWait[msg.CorrelationId]
+		o.returnsMutex.Unlock()
+		if stillWaiting {
+			t.Error("waiter was not unregistered after the grace period elapsed")
+		}
+	})
+}
+
+func TestDiskSpoolEnqueueDequeueFIFO(t *testing.T) {
+	s, err := newDiskSpool(t.TempDir(), 0, "")
+	if err != nil {
+		t.Fatalf("newDiskSpool() error = %v", err)
+	}
+
+	for _, body := range []string{"first", "second", "third"} {
+		if err := s.enqueue("ex", "rk", amqp.Publishing{Body: []byte(body)}); err != nil {
+			t.Fatalf("enqueue(%q) error = %v", body, err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	for _, want := range []string{"first", "second", "third"} {
+		rec, ok, err := s.dequeue()
+		if err != nil {
+			t.Fatalf("dequeue() error = %v", err)
+		}
+		if !ok {
+			t.Fatalf("dequeue() ok = false, want true")
+		}
+		if got := string(rec.Body); got != want {
+			t.Errorf("dequeue() body = %q, want %q", got, want)
+		}
+	}
+
+	if _, ok, err := s.dequeue(); err != nil || ok {
+		t.Errorf("dequeue() on empty spool = (_, %v, %v), want (_, false, nil)", ok, err)
+	}
+}
+
+func TestDiskSpoolRequeuePutsRecordAtTail(t *testing.T) {
+	s, err := newDiskSpool(t.TempDir(), 0, "")
+	if err != nil {
+		t.Fatalf("newDiskSpool() error = %v", err)
+	}
+
+	if err := s.enqueue("ex", "rk", amqp.Publishing{Body: []byte("a")}); err != nil {
+		t.Fatalf("enqueue() error = %v", err)
+	}
+	time.Sleep(time.Millisecond)
+	if err := s.enqueue("ex", "rk", amqp.Publishing{Body: []byte("b")}); err != nil {
+		t.Fatalf("enqueue() error = %v", err)
+	}
+
+	rec, ok, err := s.dequeue()
+	if err != nil || !ok {
+		t.Fatalf("dequeue() = (_, %v, %v)", ok, err)
+	}
+	if string(rec.Body) != "a" {
+		t.Fatalf("dequeue() body = %q, want %q", rec.Body, "a")
+	}
+
+	time.Sleep(time.Millisecond)
+	if err := s.requeue(rec); err != nil {
+		t.Fatalf("requeue() error = %v", err)
+	}
+
+	if rec, ok, err := s.dequeue(); err != nil || !ok || string(rec.Body) != "b" {
+		t.Fatalf("dequeue() = (%q, %v, %v), want (\"b\", true, nil)", rec.Body, ok, err)
+	}
+	if rec, ok, err := s.dequeue(); err != nil || !ok || string(rec.Body) != "a" {
+		t.Fatalf("dequeue() = (%q, %v, %v), want (\"a\", true, nil)", rec.Body, ok, err)
+	}
+}
+
+func TestDiskSpoolDropOldestOnOverflow(t *testing.T) {
+	dir := t.TempDir()
+	recSize, err := jsonMarshalSize(amqp.Publishing{Body: []byte("aaa")})
+	if err != nil {
+		t.Fatalf("jsonMarshalSize() error = %v", err)
+	}
+
+	// Each record below is the same size as recSize; only room for two.
+	s, err := newDiskSpool(dir, recSize*2, queueOverflowDropOldest)
+	if err != nil {
+		t.Fatalf("newDiskSpool() error = %v", err)
+	}
+
+	for _, body := range []string{"aaa", "bbb", "ccc"} {
+		if err := s.enqueue("ex", "rk", amqp.Publishing{Body: []byte(body)}); err != nil {
+			t.Fatalf("enqueue(%q) error = %v", body, err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	var got []string
+	for {
+		rec, ok, err := s.dequeue()
+		if err != nil {
+			t.Fatalf("dequeue() error = %v", err)
+		}
+		if !ok {
+			break
+		}
+		got = append(got, string(rec.Body))
+	}
+
+	if len(got) != 2 || got[0] != "bbb" || got[1] != "ccc" {
+		t.Errorf("remaining spool records = %v, want [bbb ccc]", got)
+	}
+}
+
+// jsonMarshalSize returns the on-disk size of a single spool record built
+// from msg, used to size queue_limit precisely in overflow tests.
+func jsonMarshalSize(msg amqp.Publishing) (int64, error) {
+	raw, err := json.Marshal(newSpoolRecord("ex", "rk", msg))
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(raw)), nil
+}